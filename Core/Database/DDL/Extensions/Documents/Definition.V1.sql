@@ -13,6 +13,8 @@
 
 DROP TABLE IF EXISTS documents;
 DROP TABLE IF EXISTS content_document_mappings;
+DROP TABLE IF EXISTS reading_position_document_mappings;
+DROP TABLE IF EXISTS content_document_mappings_search;
 
 DROP INDEX IF EXISTS get_by_title;
 DROP INDEX IF EXISTS get_by_project_id;
@@ -21,22 +23,49 @@ DROP INDEX IF EXISTS get_by_deleted;
 DROP INDEX IF EXISTS get_by_created;
 DROP INDEX IF EXISTS get_by_modified;
 DROP INDEX IF EXISTS get_by_created_and_modified;
+DROP INDEX IF EXISTS documents_get_by_deleted_by_document_id;
+DROP INDEX IF EXISTS content_document_mappings_get_by_content_hash;
+DROP INDEX IF EXISTS reading_position_document_mappings_get_by_user_id;
+DROP INDEX IF EXISTS reading_position_document_mappings_get_by_modified;
+
+DROP TRIGGER IF EXISTS documents_check_hierarchy_on_insert;
+DROP TRIGGER IF EXISTS documents_check_hierarchy_on_update;
+DROP TRIGGER IF EXISTS documents_check_project_on_update;
+DROP TRIGGER IF EXISTS documents_check_parent_on_restore;
+DROP TRIGGER IF EXISTS documents_cascade_move;
+DROP TRIGGER IF EXISTS documents_cascade_delete;
+DROP TRIGGER IF EXISTS documents_cascade_restore;
+DROP TRIGGER IF EXISTS content_document_mappings_check_hash_on_update;
+DROP TRIGGER IF EXISTS content_document_mappings_search_on_insert;
+DROP TRIGGER IF EXISTS content_document_mappings_search_on_update;
+DROP TRIGGER IF EXISTS content_document_mappings_search_on_delete;
+DROP TRIGGER IF EXISTS content_document_mappings_search_on_document_delete;
+DROP TRIGGER IF EXISTS content_document_mappings_search_on_document_restore;
+DROP TRIGGER IF EXISTS content_document_mappings_search_on_document_insert;
+DROP TRIGGER IF EXISTS content_document_mappings_search_on_document_hard_delete;
+DROP TRIGGER IF EXISTS reading_position_document_mappings_cleanup_on_delete;
+DROP TRIGGER IF EXISTS reading_position_document_mappings_cleanup_on_hard_delete;
 
 /*
     Documents.
     Users can create the project documentation.
     Each document (the root) belongs to the project. It can also belong to the the parent document.
+
+    Notes:
+        - The 'deleted_by_document_id' is the document whose deletion cascaded to this document.
+            It is empty for the documents that are not deleted or that were deleted on their own.
 */
 CREATE TABLE documents
 (
 
-    id          TEXT    NOT NULL PRIMARY KEY UNIQUE,
-    title       TEXT    NOT NULL,
-    project_id  TEXT    NOT NULL,
-    document_id TEXT,
-    created     INTEGER NOT NULL,
-    modified    INTEGER NOT NULL,
-    deleted     BOOLEAN NOT NULL CHECK (deleted IN (0, 1)) DEFAULT 0
+    id                     TEXT    NOT NULL PRIMARY KEY UNIQUE,
+    title                  TEXT    NOT NULL,
+    project_id             TEXT    NOT NULL,
+    document_id            TEXT,
+    created                INTEGER NOT NULL,
+    modified               INTEGER NOT NULL,
+    deleted                BOOLEAN NOT NULL CHECK (deleted IN (0, 1)) DEFAULT 0,
+    deleted_by_document_id TEXT
 );
 
 CREATE INDEX get_by_title ON documents (title);
@@ -46,21 +75,381 @@ CREATE INDEX get_by_deleted ON documents (deleted);
 CREATE INDEX get_by_created ON documents (created);
 CREATE INDEX get_by_modified ON documents (modified);
 CREATE INDEX get_by_created_and_modified ON documents (created, modified);
+CREATE INDEX documents_get_by_deleted_by_document_id ON documents (deleted_by_document_id);
+
+/*
+    Hierarchy operations are applied to the whole subtree of the document:
+        - Moving the document to another project moves all of its children, so the tree never spans projects.
+            The 'modified' is updated only for the children that are not deleted.
+            Only the root document can be moved. The child document has to be detached from its parent
+            (or attached to a parent in the target project) in the same update.
+        - Soft-deleting the document soft-deletes all of its children that are not deleted
+            and marks them with the 'deleted_by_document_id'.
+        - Restoring the document restores the children marked as deleted by it.
+            Children deleted on their own stay deleted.
+        - The document can't be restored while its parent is deleted. The cascade restores the subtree from its root,
+            so a child restored by the cascade passes once the document that deleted it is restored.
+*/
+CREATE TRIGGER documents_check_project_on_update
+    BEFORE UPDATE OF project_id
+    ON documents
+    WHEN NEW.document_id IS NOT NULL AND NEW.project_id <> OLD.project_id
+BEGIN
+
+    SELECT RAISE(ABORT, 'Parent document belongs to another project')
+    WHERE NOT EXISTS (WITH RECURSIVE ancestors(id, depth) AS (SELECT NEW.document_id, 1
+                                                             UNION ALL
+                                                             SELECT documents.document_id, ancestors.depth + 1
+                                                             FROM documents
+                                                                      JOIN ancestors ON documents.id = ancestors.id
+                                                             WHERE documents.document_id IS NOT NULL
+                                                               AND ancestors.depth < 100)
+                      SELECT 1
+                      FROM documents
+                               JOIN ancestors ON documents.id = ancestors.id
+                      WHERE documents.project_id = NEW.project_id);
+END;
+
+CREATE TRIGGER documents_cascade_move
+    AFTER UPDATE OF project_id
+    ON documents
+    WHEN NEW.project_id <> OLD.project_id
+BEGIN
+
+    UPDATE documents
+    SET project_id = NEW.project_id,
+        modified   = CASE WHEN deleted = 0 THEN NEW.modified ELSE modified END
+    WHERE id IN (WITH RECURSIVE descendants(id) AS (SELECT id
+                                                FROM documents
+                                                WHERE document_id = NEW.id
+                                                UNION
+                                                SELECT documents.id
+                                                FROM documents
+                                                         JOIN descendants ON documents.document_id = descendants.id)
+                 SELECT id
+                 FROM descendants);
+END;
+
+CREATE TRIGGER documents_cascade_delete
+    AFTER UPDATE OF deleted
+    ON documents
+    WHEN NEW.deleted = 1 AND OLD.deleted = 0
+BEGIN
+
+    UPDATE documents
+    SET deleted                = 1,
+        deleted_by_document_id = IFNULL(NEW.deleted_by_document_id, NEW.id),
+        modified               = NEW.modified
+    WHERE deleted = 0
+      AND id IN (WITH RECURSIVE descendants(id) AS (SELECT id
+                                                FROM documents
+                                                WHERE document_id = NEW.id
+                                                UNION
+                                                SELECT documents.id
+                                                FROM documents
+                                                         JOIN descendants ON documents.document_id = descendants.id)
+                 SELECT id
+                 FROM descendants);
+END;
+
+CREATE TRIGGER documents_check_parent_on_restore
+    BEFORE UPDATE OF deleted
+    ON documents
+    WHEN NEW.deleted = 0 AND OLD.deleted = 1 AND NEW.document_id IS NOT NULL
+BEGIN
+
+    SELECT RAISE(ABORT, 'Parent document is deleted')
+    FROM documents AS parent
+    WHERE parent.id = NEW.document_id
+      AND parent.deleted = 1
+      AND NOT (parent.deleted_by_document_id IS OLD.deleted_by_document_id
+        AND EXISTS (SELECT 1 FROM documents WHERE id = OLD.deleted_by_document_id AND deleted = 0));
+END;
+
+CREATE TRIGGER documents_cascade_restore
+    AFTER UPDATE OF deleted
+    ON documents
+    WHEN NEW.deleted = 0 AND OLD.deleted = 1
+BEGIN
+
+    UPDATE documents
+    SET deleted_by_document_id = NULL
+    WHERE id = NEW.id
+      AND deleted_by_document_id IS NOT NULL;
+
+    UPDATE documents
+    SET deleted                = 0,
+        deleted_by_document_id = NULL,
+        modified               = NEW.modified
+    WHERE deleted = 1
+      AND deleted_by_document_id = NEW.id;
+END;
+
+/*
+    The parent document ('document_id') must not create a cycle in the documents hierarchy.
+    Document can't be its own parent or the ancestor of its parent.
+    The hierarchy is limited to 100 levels. The levels are counted over the ancestors of the new parent
+    together with the height of the document's own subtree, so a deep subtree can't be attached to a deep chain.
+    Both lookups stop at the limit so they are always bounded.
+    The parent document must belong to the same project as the document, so the documents tree stays within one project.
+    There is no opt-in for a parent from another project.
+*/
+CREATE TRIGGER documents_check_hierarchy_on_insert
+    BEFORE INSERT
+    ON documents
+    WHEN NEW.document_id IS NOT NULL
+BEGIN
+
+    SELECT RAISE(ABORT, 'Parent document belongs to another project')
+    FROM documents
+    WHERE id = NEW.document_id
+      AND project_id <> NEW.project_id;
+
+    SELECT CASE
+               WHEN id = NEW.id THEN RAISE(ABORT, 'Circular document hierarchy')
+               ELSE RAISE(ABORT, 'Document hierarchy is too deep')
+               END
+    FROM (WITH RECURSIVE ancestors(id, depth) AS (SELECT NEW.document_id, 1
+                                                 UNION ALL
+                                                 SELECT documents.document_id, ancestors.depth + 1
+                                                 FROM documents
+                                                          JOIN ancestors ON documents.id = ancestors.id
+                                                 WHERE documents.document_id IS NOT NULL
+                                                   AND ancestors.depth < 100),
+                        descendants(id, depth) AS (SELECT NEW.id, 0
+                                                   UNION ALL
+                                                   SELECT documents.id, descendants.depth + 1
+                                                   FROM documents
+                                                            JOIN descendants ON documents.document_id = descendants.id
+                                                   WHERE descendants.depth < 100)
+          SELECT id, depth + (SELECT MAX(depth) FROM descendants) AS depth
+          FROM ancestors)
+    WHERE id = NEW.id
+       OR depth >= 100
+    ORDER BY id = NEW.id DESC
+    LIMIT 1;
+END;
+
+CREATE TRIGGER documents_check_hierarchy_on_update
+    BEFORE UPDATE OF document_id
+    ON documents
+    WHEN NEW.document_id IS NOT NULL
+BEGIN
+
+    SELECT RAISE(ABORT, 'Parent document belongs to another project')
+    FROM documents
+    WHERE id = NEW.document_id
+      AND project_id <> NEW.project_id;
+
+    SELECT CASE
+               WHEN id = NEW.id THEN RAISE(ABORT, 'Circular document hierarchy')
+               ELSE RAISE(ABORT, 'Document hierarchy is too deep')
+               END
+    FROM (WITH RECURSIVE ancestors(id, depth) AS (SELECT NEW.document_id, 1
+                                                 UNION ALL
+                                                 SELECT documents.document_id, ancestors.depth + 1
+                                                 FROM documents
+                                                          JOIN ancestors ON documents.id = ancestors.id
+                                                 WHERE documents.document_id IS NOT NULL
+                                                   AND ancestors.depth < 100),
+                        descendants(id, depth) AS (SELECT NEW.id, 0
+                                                   UNION ALL
+                                                   SELECT documents.id, descendants.depth + 1
+                                                   FROM documents
+                                                            JOIN descendants ON documents.document_id = descendants.id
+                                                   WHERE descendants.depth < 100)
+          SELECT id, depth + (SELECT MAX(depth) FROM descendants) AS depth
+          FROM ancestors)
+    WHERE id = NEW.id
+       OR depth >= 100
+    ORDER BY id = NEW.id DESC
+    LIMIT 1;
+END;
 
 /*
     Each document is associated with its content.
     The content field can contain the raw content or the 'identifier' of the content asset of some kind.
     Other content type extensions can create additional document mappings tables.
+
+    Notes:
+        - The 'content_hash' is the SHA-256 hash of the content (64 lowercase hex characters).
+            It is computed by the caller. The database checks its format and that the content is never changed
+            while the hash is kept, so a stored hash always belongs to the current content.
+            Changing the content requires providing the new hash or clearing it.
+            It is used for the integrity checks, deduplication and the conditional fetches.
+        - The 'size_bytes' is the byte length of the content (0 for no content).
+            It is computed by the database on each write so callers never provide it.
 */
 CREATE TABLE content_document_mappings
 (
 
-    id          TEXT    NOT NULL PRIMARY KEY UNIQUE,
-    document_id TEXT    NOT NULL UNIQUE,
-    content     TEXT,
-    created     INTEGER NOT NULL,
-    modified    INTEGER NOT NULL,
-    deleted     BOOLEAN NOT NULL CHECK (deleted IN (0, 1))
+    id           TEXT    NOT NULL PRIMARY KEY UNIQUE,
+    document_id  TEXT    NOT NULL UNIQUE,
+    content      TEXT,
+    content_hash TEXT CHECK (content_hash IS NULL OR
+                             (length(content_hash) = 64 AND content_hash NOT GLOB '*[^0-9a-f]*')),
+    size_bytes   INTEGER NOT NULL GENERATED ALWAYS AS (IFNULL(length(CAST(content AS BLOB)), 0)) STORED,
+    created      INTEGER NOT NULL,
+    modified     INTEGER NOT NULL,
+    deleted      BOOLEAN NOT NULL CHECK (deleted IN (0, 1))
 );
 
-CREATE INDEX IF NOT EXISTS get_by_document_id ON content_document_mappings (document_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS get_by_document_id ON content_document_mappings (document_id);
+CREATE INDEX content_document_mappings_get_by_content_hash ON content_document_mappings (content_hash);
+
+CREATE TRIGGER content_document_mappings_check_hash_on_update
+    BEFORE UPDATE OF content
+    ON content_document_mappings
+    WHEN NEW.content IS NOT OLD.content
+        AND NEW.content_hash IS OLD.content_hash
+        AND NEW.content_hash IS NOT NULL
+BEGIN
+
+    SELECT RAISE(ABORT, 'Content changed without updating its content_hash');
+END;
+
+/*
+    Full-text search index for the documents content.
+    The index is kept in sync with the 'content_document_mappings' by the triggers below.
+    Rows are matched by the 'document_id' (unique per content mapping), not by the 'rowid'.
+    The 'rowid' of the 'content_document_mappings' is not stable (VACUUM or a dump and reload can renumber it).
+
+    Notes:
+        - Only the content that is not deleted, of the documents that are not deleted, is indexed.
+            Soft-deleting (or restoring) the document removes (or restores) its content in the index immediately.
+            The content of the document removed from the table is dropped from the index.
+            Inserting the document (again) indexes its content if the document is not deleted.
+        - The 'document_id' is not indexed by FTS5, so removing the document's row from the index scans the index rows.
+        - Search results are joined back to the documents by the 'document_id'.
+        - The 'snippet' and 'bm25' FTS5 functions provide the highlighted fragment and the relevance.
+*/
+CREATE VIRTUAL TABLE content_document_mappings_search USING fts5
+(
+    document_id UNINDEXED,
+    content
+);
+
+CREATE TRIGGER content_document_mappings_search_on_insert
+    AFTER INSERT
+    ON content_document_mappings
+    WHEN NEW.deleted = 0 AND NEW.content IS NOT NULL
+        AND NOT EXISTS (SELECT 1 FROM documents WHERE id = NEW.document_id AND deleted = 1)
+BEGIN
+
+    INSERT INTO content_document_mappings_search (document_id, content)
+    VALUES (NEW.document_id, NEW.content);
+END;
+
+CREATE TRIGGER content_document_mappings_search_on_update
+    AFTER UPDATE OF content, deleted, document_id
+    ON content_document_mappings
+BEGIN
+
+    DELETE FROM content_document_mappings_search WHERE document_id = OLD.document_id;
+
+    INSERT INTO content_document_mappings_search (document_id, content)
+    SELECT NEW.document_id, NEW.content
+    WHERE NEW.deleted = 0
+      AND NEW.content IS NOT NULL
+      AND NOT EXISTS (SELECT 1 FROM documents WHERE id = NEW.document_id AND deleted = 1);
+END;
+
+CREATE TRIGGER content_document_mappings_search_on_delete
+    AFTER DELETE
+    ON content_document_mappings
+BEGIN
+
+    DELETE FROM content_document_mappings_search WHERE document_id = OLD.document_id;
+END;
+
+CREATE TRIGGER content_document_mappings_search_on_document_delete
+    AFTER UPDATE OF deleted
+    ON documents
+    WHEN NEW.deleted = 1 AND OLD.deleted = 0
+BEGIN
+
+    DELETE FROM content_document_mappings_search WHERE document_id = NEW.id;
+END;
+
+CREATE TRIGGER content_document_mappings_search_on_document_restore
+    AFTER UPDATE OF deleted
+    ON documents
+    WHEN NEW.deleted = 0 AND OLD.deleted = 1
+BEGIN
+
+    DELETE FROM content_document_mappings_search WHERE document_id = NEW.id;
+
+    INSERT INTO content_document_mappings_search (document_id, content)
+    SELECT document_id, content
+    FROM content_document_mappings
+    WHERE document_id = NEW.id
+      AND deleted = 0
+      AND content IS NOT NULL;
+END;
+
+CREATE TRIGGER content_document_mappings_search_on_document_insert
+    AFTER INSERT
+    ON documents
+BEGIN
+
+    DELETE FROM content_document_mappings_search WHERE document_id = NEW.id;
+
+    INSERT INTO content_document_mappings_search (document_id, content)
+    SELECT document_id, content
+    FROM content_document_mappings
+    WHERE document_id = NEW.id
+      AND deleted = 0
+      AND content IS NOT NULL
+      AND NEW.deleted = 0;
+END;
+
+CREATE TRIGGER content_document_mappings_search_on_document_hard_delete
+    AFTER DELETE
+    ON documents
+BEGIN
+
+    DELETE FROM content_document_mappings_search WHERE document_id = OLD.id;
+END;
+
+/*
+    Reading positions.
+    Each user has up to one reading position per document so reading can be resumed on another device.
+    The 'anchor' is the section identifier or the scroll anchor and the 'anchor_offset' is the offset from it.
+
+    Notes:
+        - Reading positions are high volume and not audited. Rows are upserted and never soft-deleted.
+        - Positions are removed once the document gets deleted.
+        - Lookups by the 'document_id' use the index of the unique ('document_id', 'user_id') pair.
+*/
+CREATE TABLE reading_position_document_mappings
+(
+
+    id            TEXT    NOT NULL PRIMARY KEY UNIQUE,
+    document_id   TEXT    NOT NULL,
+    user_id       TEXT    NOT NULL,
+    anchor        TEXT,
+    anchor_offset INTEGER NOT NULL DEFAULT 0,
+    created       INTEGER NOT NULL,
+    modified      INTEGER NOT NULL,
+    UNIQUE (document_id, user_id) ON CONFLICT ABORT
+);
+
+CREATE INDEX reading_position_document_mappings_get_by_user_id ON reading_position_document_mappings (user_id);
+CREATE INDEX reading_position_document_mappings_get_by_modified ON reading_position_document_mappings (modified);
+
+CREATE TRIGGER reading_position_document_mappings_cleanup_on_delete
+    AFTER UPDATE OF deleted
+    ON documents
+    WHEN NEW.deleted = 1
+BEGIN
+
+    DELETE FROM reading_position_document_mappings WHERE document_id = NEW.id;
+END;
+
+CREATE TRIGGER reading_position_document_mappings_cleanup_on_hard_delete
+    AFTER DELETE
+    ON documents
+BEGIN
+
+    DELETE FROM reading_position_document_mappings WHERE document_id = OLD.id;
+END;